@@ -0,0 +1,159 @@
+package ffmpeg
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/stashapp/stash/pkg/file"
+)
+
+// BitrateLadderRung is a single quality rendition offered for adaptive
+// streaming: a target output height and the video bitrate that should
+// accompany it.
+type BitrateLadderRung struct {
+	Name    string // eg "720p"
+	Height  int
+	Width   int // scaled to preserve the source's aspect ratio, rounded to even
+	Bitrate int // kbps
+}
+
+// RateControlArgs returns the -b:v/-maxrate/-bufsize arguments that cap the
+// encoder's output to this rung's bitrate, allowing the client to make
+// predictable bandwidth decisions instead of relying solely on CRF.
+func (r BitrateLadderRung) RateControlArgs() Args {
+	bitrate := fmt.Sprintf("%dk", r.Bitrate)
+	return Args{
+		"-b:v", bitrate,
+		"-maxrate", fmt.Sprintf("%dk", r.Bitrate*117/100),
+		"-bufsize", fmt.Sprintf("%dk", r.Bitrate*2),
+	}
+}
+
+// DefaultBitrateLadder is the set of renditions offered for adaptive
+// streaming, matching what modern VOD backends typically produce.
+var DefaultBitrateLadder = []BitrateLadderRung{
+	{Name: "360p", Height: 360, Bitrate: 800},
+	{Name: "480p", Height: 480, Bitrate: 1500},
+	{Name: "720p", Height: 720, Bitrate: 3000},
+	{Name: "1080p", Height: 1080, Bitrate: 5000},
+	{Name: "1440p", Height: 1440, Bitrate: 9000},
+	{Name: "2160p", Height: 2160, Bitrate: 14000},
+}
+
+// RungsFor returns every ladder rung at or below the source file's height,
+// plus one rung at the source's native resolution so a fast connection
+// isn't capped below the file's actual quality.
+func RungsFor(videoFile *file.VideoFile) []BitrateLadderRung {
+	var rungs []BitrateLadderRung
+	for _, r := range DefaultBitrateLadder {
+		if r.Height <= videoFile.Height {
+			r.Width = scaledWidth(videoFile, r.Height)
+			rungs = append(rungs, r)
+		}
+	}
+
+	if len(rungs) == 0 || rungs[len(rungs)-1].Height != videoFile.Height {
+		rungs = append(rungs, nativeRung(videoFile))
+	}
+
+	return rungs
+}
+
+// scaledWidth returns the width that preserves videoFile's aspect ratio at
+// the given output height, rounded up to an even number as most encoders
+// require.
+func scaledWidth(videoFile *file.VideoFile, height int) int {
+	if videoFile.Height == 0 {
+		return height
+	}
+
+	width := int(float64(height) * float64(videoFile.Width) / float64(videoFile.Height))
+	if width%2 != 0 {
+		width++
+	}
+	return width
+}
+
+// nativeRung builds a rung at the source's exact dimensions, with a bitrate
+// interpolated from the surrounding default rungs.
+func nativeRung(videoFile *file.VideoFile) BitrateLadderRung {
+	return BitrateLadderRung{
+		Name:    fmt.Sprintf("%dp", videoFile.Height),
+		Height:  videoFile.Height,
+		Width:   videoFile.Width,
+		Bitrate: interpolateBitrate(videoFile.Height),
+	}
+}
+
+// interpolateBitrate linearly interpolates (or extrapolates, for 4K+
+// sources) a bitrate for a height that falls between or beyond the default
+// ladder's rungs.
+func interpolateBitrate(height int) int {
+	rungs := DefaultBitrateLadder
+
+	if height <= rungs[0].Height {
+		return rungs[0].Bitrate
+	}
+	if height >= rungs[len(rungs)-1].Height {
+		last, prev := rungs[len(rungs)-1], rungs[len(rungs)-2]
+		slope := float64(last.Bitrate-prev.Bitrate) / float64(last.Height-prev.Height)
+		return last.Bitrate + int(slope*float64(height-last.Height))
+	}
+
+	for i := 1; i < len(rungs); i++ {
+		if height <= rungs[i].Height {
+			lo, hi := rungs[i-1], rungs[i]
+			frac := float64(height-lo.Height) / float64(hi.Height-lo.Height)
+			return lo.Bitrate + int(frac*float64(hi.Bitrate-lo.Bitrate))
+		}
+	}
+
+	return rungs[len(rungs)-1].Bitrate
+}
+
+// NearestRung picks the ladder rung closest to the requested viewport
+// height, clamped to the rungs available for this source file. A
+// viewportHeight of 0 (unknown) resolves to the highest available rung.
+func NearestRung(videoFile *file.VideoFile, viewportHeight int) BitrateLadderRung {
+	rungs := RungsFor(videoFile)
+
+	if viewportHeight <= 0 {
+		return rungs[len(rungs)-1]
+	}
+
+	best := rungs[0]
+	bestDiff := abs(best.Height - viewportHeight)
+	for _, r := range rungs[1:] {
+		if diff := abs(r.Height - viewportHeight); diff < bestDiff {
+			best, bestDiff = r, diff
+		}
+	}
+	return best
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// viewportHeightHint extracts the client's viewport height from the
+// Sec-CH-Viewport-Height client hint header, falling back to a
+// "viewport_height" query parameter.
+func viewportHeightHint(r *http.Request) int {
+	if h := r.Header.Get("Sec-CH-Viewport-Height"); h != "" {
+		if v, err := strconv.Atoi(h); err == nil {
+			return v
+		}
+	}
+
+	if h := r.URL.Query().Get("viewport_height"); h != "" {
+		if v, err := strconv.Atoi(h); err == nil {
+			return v
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,154 @@
+package ffmpeg
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/stashapp/stash/pkg/file"
+)
+
+// codecCompatibility lists the video and audio codecs that a StreamFormat's
+// container/player combination can play natively, without transcoding.
+type codecCompatibility struct {
+	videoCodecs []string
+	audioCodecs []string
+}
+
+var copyCompatibility = map[string]codecCompatibility{
+	MimeMp4Video: {
+		videoCodecs: []string{"h264"},
+		audioCodecs: []string{"aac", "opus"},
+	},
+	MimeWebmVideo: {
+		videoCodecs: []string{"vp9", "av1"},
+		audioCodecs: []string{"opus", "vorbis"},
+	},
+	MimeMkvVideo: {
+		// MKV is a near-universal container; almost anything a browser's
+		// MSE implementation can decode can also be muxed into it untouched.
+		videoCodecs: []string{"h264", "hevc", "vp8", "vp9", "av1"},
+		audioCodecs: []string{"aac", "opus", "vorbis", "mp3", "flac"},
+	},
+}
+
+// ShouldCopy determines whether the source video and/or audio streams of
+// videoFile can be passed through with -c:v copy / -c:a copy for streamType
+// rather than re-encoded, avoiding the cost of a transcode for the common
+// case where a file just needs remuxing for the browser. copyVideo is only
+// true when no scaling is required, since a copy can't be scaled.
+func ShouldCopy(videoFile *file.VideoFile, streamType StreamFormat, maxTranscodeHeight int) (copyVideo, copyAudio bool) {
+	compat, ok := copyCompatibility[streamType.MimeType]
+	if !ok {
+		return false, false
+	}
+
+	noScalingRequired := maxTranscodeHeight == 0 || videoFile.Height <= maxTranscodeHeight
+
+	copyVideo = noScalingRequired && codecIn(videoFile.VideoCodec, compat.videoCodecs) && isCopySafeH264(videoFile)
+	copyAudio = codecIn(videoFile.AudioCodec, compat.audioCodecs)
+
+	return
+}
+
+func codecIn(codec string, accepted []string) bool {
+	codec = strings.ToLower(codec)
+	for _, a := range accepted {
+		if codec == a {
+			return true
+		}
+	}
+	return false
+}
+
+// copySafeH264Profiles lists the H.264 profiles that browsers' MSE
+// implementations can reliably decode. Profiles outside this set (eg
+// High 10, High 4:2:2, High 4:4:4 Predictive) use sample formats most
+// software/hardware decoders reject, so a source encoded with one of them
+// must always be re-encoded, even though its codec name is still "h264".
+var copySafeH264Profiles = map[string]bool{
+	"constrained baseline": true,
+	"baseline":             true,
+	"main":                 true,
+	"high":                 true,
+}
+
+// maxCopySafeH264Level is the highest H.264 level (5.1, stored as 51 by
+// ffprobe) widely supported by browser MSE decoders without dropping to
+// software fallback.
+const maxCopySafeH264Level = 51
+
+// h264ProfileProbe probes path's first video stream for its H.264 profile
+// and level. It is a package variable so tests can stub it out without
+// shelling out to a real ffprobe binary.
+var h264ProfileProbe = probeH264Profile
+
+type h264Profile struct {
+	name  string
+	level int
+}
+
+// probeH264Profile result is cached per path, since ShouldCopy is called on
+// every transcode request for the same handful of files.
+var h264ProfileCache sync.Map // path string -> h264Profile
+
+// isCopySafeH264 reports whether videoFile's stream is safe to copy
+// unchanged into an H.264 container. It only gates H.264 sources; other
+// codecs are already restricted to a known-safe list in copyCompatibility.
+func isCopySafeH264(videoFile *file.VideoFile) bool {
+	if strings.ToLower(videoFile.VideoCodec) != "h264" {
+		return true
+	}
+
+	profile, ok := probeH264ProfileCached(videoFile.Path)
+	if !ok {
+		// couldn't determine the profile/level; don't risk copying a stream
+		// that might not actually be MSE-decodable.
+		return false
+	}
+
+	return copySafeH264Profiles[profile.name] && profile.level <= maxCopySafeH264Level
+}
+
+func probeH264ProfileCached(path string) (h264Profile, bool) {
+	if cached, ok := h264ProfileCache.Load(path); ok {
+		return cached.(h264Profile), true
+	}
+
+	profile, err := h264ProfileProbe(path)
+	if err != nil {
+		return h264Profile{}, false
+	}
+
+	h264ProfileCache.Store(path, profile)
+	return profile, true
+}
+
+// probeH264Profile runs ffprobe against path to read the profile and level
+// of its first video stream.
+func probeH264Profile(path string) (h264Profile, error) {
+	out, err := exec.Command("ffprobe",
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "stream=profile,level",
+		"-of", "csv=p=0",
+		path,
+	).Output()
+	if err != nil {
+		return h264Profile{}, err
+	}
+
+	fields := strings.Split(strings.TrimSpace(string(out)), ",")
+	if len(fields) != 2 {
+		return h264Profile{}, fmt.Errorf("unexpected ffprobe output for %s: %q", path, out)
+	}
+
+	level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+	if err != nil {
+		return h264Profile{}, fmt.Errorf("parsing h264 level for %s: %w", path, err)
+	}
+
+	return h264Profile{name: strings.ToLower(strings.TrimSpace(fields[0])), level: level}, nil
+}
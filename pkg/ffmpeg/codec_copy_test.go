@@ -0,0 +1,121 @@
+package ffmpeg
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stashapp/stash/pkg/file"
+)
+
+func TestShouldCopy(t *testing.T) {
+	tests := []struct {
+		name               string
+		videoFile          *file.VideoFile
+		streamType         StreamFormat
+		maxTranscodeHeight int
+		mockProfile        h264Profile
+		mockProfileErr     error
+		wantCopyVideo      bool
+		wantCopyAudio      bool
+	}{
+		{
+			name:               "mp4 h264 main profile copies",
+			videoFile:          &file.VideoFile{Height: 720, VideoCodec: "h264", AudioCodec: "aac"},
+			streamType:         StreamTypeMP4,
+			maxTranscodeHeight: 1080,
+			mockProfile:        h264Profile{name: "main", level: 40},
+			wantCopyVideo:      true,
+			wantCopyAudio:      true,
+		},
+		{
+			name:               "mp4 h264 high10 profile cannot copy video",
+			videoFile:          &file.VideoFile{Height: 720, VideoCodec: "h264", AudioCodec: "aac"},
+			streamType:         StreamTypeMP4,
+			maxTranscodeHeight: 1080,
+			mockProfile:        h264Profile{name: "high 10", level: 40},
+			wantCopyVideo:      false,
+			wantCopyAudio:      true,
+		},
+		{
+			name:               "mp4 h264 level above 5.1 cannot copy video",
+			videoFile:          &file.VideoFile{Height: 2160, VideoCodec: "h264", AudioCodec: "aac"},
+			streamType:         StreamTypeMP4,
+			maxTranscodeHeight: 0,
+			mockProfile:        h264Profile{name: "high", level: 52},
+			wantCopyVideo:      false,
+			wantCopyAudio:      true,
+		},
+		{
+			name:               "mp4 needing downscale cannot copy video",
+			videoFile:          &file.VideoFile{Height: 1080, VideoCodec: "h264", AudioCodec: "aac"},
+			streamType:         StreamTypeMP4,
+			maxTranscodeHeight: 720,
+			mockProfile:        h264Profile{name: "main", level: 40},
+			wantCopyVideo:      false,
+			wantCopyAudio:      true,
+		},
+		{
+			name:               "mp4 unprobeable profile cannot copy video",
+			videoFile:          &file.VideoFile{Height: 720, VideoCodec: "h264", AudioCodec: "aac"},
+			streamType:         StreamTypeMP4,
+			maxTranscodeHeight: 1080,
+			mockProfileErr:     errUnprobeable,
+			wantCopyVideo:      false,
+			wantCopyAudio:      true,
+		},
+		{
+			name:               "webm vp9/opus copies without consulting h264 profile",
+			videoFile:          &file.VideoFile{Height: 720, VideoCodec: "vp9", AudioCodec: "opus"},
+			streamType:         StreamTypeWEBM,
+			maxTranscodeHeight: 1080,
+			wantCopyVideo:      true,
+			wantCopyAudio:      true,
+		},
+		{
+			name:               "mp4 unsupported video codec never copies",
+			videoFile:          &file.VideoFile{Height: 720, VideoCodec: "mpeg2video", AudioCodec: "aac"},
+			streamType:         StreamTypeMP4,
+			maxTranscodeHeight: 1080,
+			wantCopyVideo:      false,
+			wantCopyAudio:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withStubbedH264Profile(t, tt.mockProfile, tt.mockProfileErr)
+
+			gotCopyVideo, gotCopyAudio := ShouldCopy(tt.videoFile, tt.streamType, tt.maxTranscodeHeight)
+			if gotCopyVideo != tt.wantCopyVideo {
+				t.Errorf("copyVideo = %v, want %v", gotCopyVideo, tt.wantCopyVideo)
+			}
+			if gotCopyAudio != tt.wantCopyAudio {
+				t.Errorf("copyAudio = %v, want %v", gotCopyAudio, tt.wantCopyAudio)
+			}
+		})
+	}
+}
+
+var errUnprobeable = &probeError{"ffprobe failed"}
+
+type probeError struct{ msg string }
+
+func (e *probeError) Error() string { return e.msg }
+
+// withStubbedH264Profile replaces the package's h264ProfileProbe for the
+// duration of the test, so ShouldCopy's profile/level gate can be exercised
+// without a real ffprobe binary or media file.
+func withStubbedH264Profile(t *testing.T, profile h264Profile, err error) {
+	t.Helper()
+
+	orig := h264ProfileProbe
+	h264ProfileProbe = func(path string) (h264Profile, error) {
+		return profile, err
+	}
+	h264ProfileCache = sync.Map{}
+
+	t.Cleanup(func() {
+		h264ProfileProbe = orig
+		h264ProfileCache = sync.Map{}
+	})
+}
@@ -0,0 +1,499 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stashapp/stash/pkg/file"
+	"github.com/stashapp/stash/pkg/logger"
+)
+
+const (
+	hlsChunkDuration     = 3 * time.Second
+	hlsGoalBufferMax     = 5
+	hlsStreamIdleTimeout = 2 * time.Minute
+)
+
+type hlsChunkStatus int
+
+const (
+	hlsChunkPending hlsChunkStatus = iota
+	hlsChunkEncoding
+	hlsChunkReady
+)
+
+// hlsChunk is a single addressable .ts/.m4s segment of an HLSStream.
+type hlsChunk struct {
+	status hlsChunkStatus
+	data   []byte
+	cmd    *exec.Cmd     // the in-flight ffmpeg process producing this chunk, if any
+	notify chan struct{} // closed once status moves to hlsChunkReady (or back to pending on failure)
+}
+
+func newHLSChunk() *hlsChunk {
+	return &hlsChunk{notify: make(chan struct{})}
+}
+
+// HLSStream tracks the encoding state of a single video file/quality
+// combination: which chunks are ready, which one is currently being
+// produced, and the ffmpeg process generating it.
+type HLSStream struct {
+	sm        *StreamManager
+	videoFile *file.VideoFile
+	rendition BitrateLadderRung
+	cache     *TranscodeCache // nil if caching is disabled
+
+	mu      sync.Mutex
+	chunks  map[int]*hlsChunk
+	offsets []float64 // keyframe-aligned start time of each chunk, in seconds
+
+	goal      int // index of the furthest chunk requested so far; lookahead encodes run past it
+	idleTimer *time.Timer
+
+	// onIdle, if set, is called after an idle timeout kills this stream's
+	// in-flight encodes, so HLSStreamManager can evict it from m.streams
+	// instead of holding its (potentially large) keyframe offsets forever.
+	onIdle func()
+}
+
+func newHLSStream(sm *StreamManager, videoFile *file.VideoFile, rendition BitrateLadderRung, cache *TranscodeCache, onIdle func()) *HLSStream {
+	s := &HLSStream{
+		sm:        sm,
+		videoFile: videoFile,
+		rendition: rendition,
+		cache:     cache,
+		chunks:    make(map[int]*hlsChunk),
+		offsets:   chunkOffsets(videoFile),
+		onIdle:    onIdle,
+	}
+	s.resetIdleTimer()
+	return s
+}
+
+func (s *HLSStream) cacheKey(index int) TranscodeCacheKey {
+	return TranscodeCacheKey{
+		FileHash:   fileCacheKey(s.videoFile),
+		StreamType: "hls",
+		Resolution: s.rendition.Name,
+		ChunkIndex: index,
+	}
+}
+
+// chunkOffsets splits the file's duration into hlsChunkDuration-sized pieces,
+// snapping each boundary to the nearest detected keyframe so that segments
+// can be cut with -ss/-t without re-encoding across a GOP boundary.
+func chunkOffsets(videoFile *file.VideoFile) []float64 {
+	duration := videoFile.Duration
+
+	keyframes, err := probeKeyframes(videoFile.Path)
+	if err != nil || len(keyframes) == 0 {
+		logger.Warnf("[hls] unable to probe keyframes for %s, falling back to fixed-size chunks: %v", videoFile.Path, err)
+		var offsets []float64
+		for t := 0.0; t < duration; t += hlsChunkDuration.Seconds() {
+			offsets = append(offsets, t)
+		}
+		return offsets
+	}
+
+	var offsets []float64
+	target := 0.0
+	for _, kf := range keyframes {
+		if kf >= target {
+			offsets = append(offsets, kf)
+			target = kf + hlsChunkDuration.Seconds()
+		}
+	}
+	return offsets
+}
+
+// probeKeyframes returns the presentation timestamps, in seconds, of every
+// keyframe in the video stream, as reported by ffprobe.
+func probeKeyframes(path string) ([]float64, error) {
+	cmd := exec.Command("ffprobe",
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-skip_frame", "nokey",
+		"-show_entries", "frame=pts_time",
+		"-of", "csv=p=0",
+		path,
+	)
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var keyframes []float64
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		pts, err := strconv.ParseFloat(line, 64)
+		if err != nil {
+			continue
+		}
+		keyframes = append(keyframes, pts)
+	}
+	return keyframes, nil
+}
+
+func (s *HLSStream) resetIdleTimer() {
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+	}
+	s.idleTimer = time.AfterFunc(hlsStreamIdleTimeout, s.killIdle)
+}
+
+func (s *HLSStream) killIdle() {
+	s.mu.Lock()
+	for _, c := range s.chunks {
+		if c.cmd != nil && c.cmd.Process != nil {
+			logger.Debugf("[hls] killing idle encoder for %s (%s)", s.videoFile.Path, s.rendition.Name)
+			_ = c.cmd.Process.Kill()
+		}
+	}
+	s.chunks = make(map[int]*hlsChunk)
+	s.mu.Unlock()
+
+	// Evict this stream from the manager after releasing s.mu, since
+	// removeStream only touches HLSStreamManager.mu and calling out while
+	// still holding s.mu would invite a lock-ordering hazard if that ever
+	// changes.
+	if s.onIdle != nil {
+		s.onIdle()
+	}
+}
+
+// errChunkOutOfRange is returned by chunk when index doesn't address an
+// actual segment of the stream, so callers can tell an out-of-range request
+// apart from a valid chunk that simply failed to encode.
+var errChunkOutOfRange = errors.New("chunk index out of range")
+
+// chunk returns the chunk at index, starting its encode (and prefetching up
+// to GoalBufferMax chunks ahead of it) as necessary, and blocks until it is
+// ready or the request is cancelled.
+func (s *HLSStream) chunk(ctx context.Context, index int) (*hlsChunk, error) {
+	s.mu.Lock()
+
+	if index < 0 || index >= len(s.offsets) {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("%w: %d (have %d chunks)", errChunkOutOfRange, index, len(s.offsets))
+	}
+
+	s.resetIdleTimer()
+
+	c := s.ensureChunkLocked(index)
+	s.updateGoalLocked(index)
+
+	s.mu.Unlock()
+
+	select {
+	case <-c.notify:
+		if c.status != hlsChunkReady {
+			return nil, fmt.Errorf("chunk %d failed to encode", index)
+		}
+		return c, nil
+	case <-ctx.Done():
+		return nil, errors.New("request cancelled")
+	}
+}
+
+// ensureChunkLocked returns the chunk at index, creating it and starting its
+// encode if this is the first request for it. Callers must hold s.mu.
+func (s *HLSStream) ensureChunkLocked(index int) *hlsChunk {
+	if c, ok := s.chunks[index]; ok {
+		return c
+	}
+
+	c := newHLSChunk()
+	s.chunks[index] = c
+	s.startEncode(index, c)
+	return c
+}
+
+// updateGoalLocked records index as the furthest chunk currently being
+// watched, kicks off lookahead encodes for up to GoalBufferMax chunks ahead
+// of it, and prunes chunks that have fallen more than GoalBufferMax behind
+// (eg after the client has seeked forward). Callers must hold s.mu.
+func (s *HLSStream) updateGoalLocked(index int) {
+	if index > s.goal {
+		s.goal = index
+	}
+
+	for i := index + 1; i <= index+hlsGoalBufferMax && i < len(s.offsets); i++ {
+		s.ensureChunkLocked(i)
+	}
+
+	for i, c := range s.chunks {
+		if i < s.goal-hlsGoalBufferMax {
+			if c.cmd != nil && c.cmd.Process != nil {
+				_ = c.cmd.Process.Kill()
+			}
+			delete(s.chunks, i)
+		}
+	}
+}
+
+// startEncode kicks off the encode for a chunk: if caching is enabled, it
+// goes through the cache's own generate-and-coalesce path so that a cache
+// hit never spawns ffmpeg at all; otherwise it encodes directly. index must
+// already be known to be in range (see chunk). Callers must hold s.mu.
+func (s *HLSStream) startEncode(index int, c *hlsChunk) {
+	c.status = hlsChunkEncoding
+	go s.runEncode(index, c)
+}
+
+// runEncode produces (or fetches from cache) the bytes for chunk index and
+// notifies anyone blocked on c.notify. It does not hold s.mu while ffmpeg is
+// running.
+func (s *HLSStream) runEncode(index int, c *hlsChunk) {
+	generate := func() ([]byte, error) {
+		return s.encodeChunk(index, c)
+	}
+
+	var data []byte
+	var err error
+	if s.cache != nil {
+		data, err = s.cache.GetOrGenerate(s.cacheKey(index), generate)
+	} else {
+		data, err = generate()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c.cmd = nil
+
+	if err != nil {
+		logger.Errorf("[hls] ffmpeg error encoding chunk %d of %s: %v", index, s.videoFile.Path, err)
+		c.status = hlsChunkPending
+		close(c.notify)
+		return
+	}
+
+	c.data = data
+	c.status = hlsChunkReady
+	close(c.notify)
+}
+
+// encodeChunk spawns the ffmpeg process that produces a single bounded
+// chunk: -ss seeks to the chunk's keyframe-aligned offset, and -t stops the
+// encode at the next chunk boundary (or the end of the file for the last
+// chunk), so each request only ever waits on a short, independent encode.
+func (s *HLSStream) encodeChunk(index int, c *hlsChunk) ([]byte, error) {
+	start := s.offsets[index]
+	duration := s.chunkDuration(index)
+
+	args := Args{"-hide_banner"}
+	args = args.LogLevel(LogLevelError)
+	args = args.Seek(start)
+	args = args.Input(s.videoFile.Path)
+	args = append(args, "-t", strconv.FormatFloat(duration, 'f', 3, 64))
+
+	var videoFilter VideoFilter
+	videoFilter = videoFilter.ScaleMax(s.videoFile.Width, s.videoFile.Height, s.rendition.Height)
+
+	args = args.VideoCodec(VideoCodecLibX264)
+	args = append(args,
+		"-pix_fmt", "yuv420p",
+		"-preset", "veryfast",
+		"-copyts", "-muxdelay", "0", "-muxpreload", "0",
+	)
+	args = append(args, s.rendition.RateControlArgs()...)
+	args = args.VideoFilter(videoFilter)
+	args = append(args, "-ac", "2")
+	args = args.Format(FormatMpegts)
+	args = args.Output("pipe:")
+
+	// Hold a read lock on the source file for the lifetime of the encode, the
+	// same as any other transcode path in this package, so a concurrent
+	// library rescan can't move or delete it out from under ffmpeg.
+	lockCtx := s.sm.lockManager.ReadLock(context.Background(), s.videoFile.Path)
+	cmd := s.sm.encoder.Command(lockCtx, args)
+
+	var buf bytes.Buffer
+	cmd.Stdout = &buf
+
+	s.mu.Lock()
+	c.cmd = cmd
+	s.mu.Unlock()
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	lockCtx.AttachCommand(cmd)
+
+	if err := cmd.Wait(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// chunkDuration returns the length, in seconds, of the chunk starting at
+// index, measured to the next chunk's offset (or the end of the file for
+// the last chunk).
+func (s *HLSStream) chunkDuration(index int) float64 {
+	if index+1 < len(s.offsets) {
+		return s.offsets[index+1] - s.offsets[index]
+	}
+	return s.videoFile.Duration - s.offsets[index]
+}
+
+// HLSStreamManager serves HLS master/media playlists and individually
+// addressable chunks for video files, generating each chunk on demand.
+type HLSStreamManager struct {
+	sm    *StreamManager
+	cache *TranscodeCache // nil if caching is disabled
+
+	mu      sync.Mutex
+	streams map[string]*HLSStream // keyed by file path + rendition name
+}
+
+func NewHLSStreamManager(sm *StreamManager, cache *TranscodeCache) *HLSStreamManager {
+	return &HLSStreamManager{
+		sm:      sm,
+		cache:   cache,
+		streams: make(map[string]*HLSStream),
+	}
+}
+
+func (m *HLSStreamManager) getStream(videoFile *file.VideoFile, rendition BitrateLadderRung) *HLSStream {
+	key := videoFile.Path + "|" + rendition.Name
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.streams[key]
+	if !ok {
+		s = newHLSStream(m.sm, videoFile, rendition, m.cache, func() { m.removeStream(key, s) })
+		m.streams[key] = s
+	}
+	return s
+}
+
+// removeStream drops key from m.streams, but only if it still points at s —
+// a new stream may already have replaced it by the time an old one's idle
+// timeout fires, and that replacement must not be evicted out from under it.
+func (m *HLSStreamManager) removeStream(key string, s *HLSStream) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.streams[key] == s {
+		delete(m.streams, key)
+	}
+}
+
+// Prewarm pre-transcodes every chunk of videoFile at the given rendition so
+// that subsequent playback requests are served directly from the cache.
+func (m *HLSStreamManager) Prewarm(videoFile *file.VideoFile, renditionName string) error {
+	rendition, ok := findRendition(videoFile, renditionName)
+	if !ok {
+		return fmt.Errorf("unknown rendition %q", renditionName)
+	}
+
+	s := m.getStream(videoFile, rendition)
+	for i := range s.offsets {
+		if _, err := s.chunk(context.Background(), i); err != nil {
+			return fmt.Errorf("prewarming chunk %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// CacheStats returns the underlying TranscodeCache's hit/miss/eviction
+// counters, or a zero value if caching is disabled.
+func (m *HLSStreamManager) CacheStats() TranscodeCacheStats {
+	if m.cache == nil {
+		return TranscodeCacheStats{}
+	}
+	return m.cache.Stats()
+}
+
+// ServeManifest writes the HLS master playlist, referencing a media
+// playlist for every rendition in the bitrate ladder.
+func (m *HLSStreamManager) ServeManifest(w http.ResponseWriter, r *http.Request, videoFile *file.VideoFile) {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+
+	for _, rendition := range RungsFor(videoFile) {
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d\n", rendition.Bitrate*1000, rendition.Width, rendition.Height)
+		fmt.Fprintf(&b, "%s/stream.m3u8\n", rendition.Name)
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	_, _ = io.WriteString(w, b.String())
+}
+
+// ServeMediaPlaylist writes the per-rendition VOD media playlist, with
+// #EXTINF durations taken from the actual keyframe-aligned chunk
+// boundaries rather than a fixed duration.
+func (m *HLSStreamManager) ServeMediaPlaylist(w http.ResponseWriter, r *http.Request, videoFile *file.VideoFile, renditionName string) {
+	rendition, ok := findRendition(videoFile, renditionName)
+	if !ok {
+		http.Error(w, "unknown rendition", http.StatusNotFound)
+		return
+	}
+
+	s := m.getStream(videoFile, rendition)
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-TARGETDURATION:")
+	fmt.Fprintf(&b, "%d\n", int(hlsChunkDuration.Seconds())+1)
+	b.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+
+	for i, offset := range s.offsets {
+		end := videoFile.Duration
+		if i+1 < len(s.offsets) {
+			end = s.offsets[i+1]
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%d.ts\n", end-offset, i)
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	_, _ = io.WriteString(w, b.String())
+}
+
+// ServeChunk serves (generating if necessary) a single .ts segment.
+func (m *HLSStreamManager) ServeChunk(w http.ResponseWriter, r *http.Request, videoFile *file.VideoFile, renditionName string, index int) {
+	rendition, ok := findRendition(videoFile, renditionName)
+	if !ok {
+		http.Error(w, "unknown rendition", http.StatusNotFound)
+		return
+	}
+
+	s := m.getStream(videoFile, rendition)
+
+	c, err := s.chunk(r.Context(), index)
+	if err != nil {
+		if errors.Is(err, errChunkOutOfRange) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		logger.Errorf("[hls] error generating chunk %d of %s: %v", index, videoFile.Path, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "video/mp2t")
+	_, _ = w.Write(c.data)
+}
+
+func findRendition(videoFile *file.VideoFile, name string) (BitrateLadderRung, bool) {
+	for _, r := range RungsFor(videoFile) {
+		if r.Name == name {
+			return r, true
+		}
+	}
+	return BitrateLadderRung{}, false
+}
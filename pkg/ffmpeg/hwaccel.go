@@ -0,0 +1,227 @@
+package ffmpeg
+
+import (
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/stashapp/stash/pkg/logger"
+)
+
+// HWAccelPreference is the configured hardware acceleration mode, as exposed
+// by config.GetTranscodeHWAccel().
+type HWAccelPreference string
+
+const (
+	HWAccelDisabled     HWAccelPreference = "disabled"
+	HWAccelAuto         HWAccelPreference = "auto"
+	HWAccelNVENC        HWAccelPreference = "nvenc"
+	HWAccelQSV          HWAccelPreference = "qsv"
+	HWAccelVAAPI        HWAccelPreference = "vaapi"
+	HWAccelVideoToolbox HWAccelPreference = "videotoolbox"
+)
+
+// HWAccelCodecKind identifies which video codec a hardware encoder
+// produces, since a single backend (eg NVENC) usually offers both an H.264
+// and an HEVC encoder.
+type HWAccelCodecKind string
+
+const (
+	HWAccelCodecKindH264 HWAccelCodecKind = "h264"
+	HWAccelCodecKindHEVC HWAccelCodecKind = "hevc"
+)
+
+// HWAccelCodec describes a single usable hardware encoder: the ffmpeg codec
+// name to use, and the device/filter arguments it requires.
+type HWAccelCodec struct {
+	Name       string
+	Preference HWAccelPreference
+	Kind       HWAccelCodecKind
+	VideoCodec VideoCodec
+}
+
+// DeviceArgs returns the input-side arguments (-hwaccel, -init_hw_device,
+// ...) that must appear before -i.
+func (c *HWAccelCodec) DeviceArgs() Args {
+	switch c.Preference {
+	case HWAccelNVENC:
+		return Args{"-hwaccel", "cuda", "-hwaccel_output_format", "cuda"}
+	case HWAccelQSV:
+		return Args{"-hwaccel", "qsv", "-hwaccel_output_format", "qsv"}
+	case HWAccelVAAPI:
+		return Args{"-init_hw_device", "vaapi=va:/dev/dri/renderD128", "-hwaccel", "vaapi", "-hwaccel_output_format", "vaapi"}
+	case HWAccelVideoToolbox:
+		return Args{"-hwaccel", "videotoolbox"}
+	}
+	return nil
+}
+
+// EncodeArgs returns additional output-side encoder arguments specific to
+// this hardware backend (eg rate control options that differ from the
+// software encoder's -crf).
+func (c *HWAccelCodec) EncodeArgs() Args {
+	switch c.Preference {
+	case HWAccelNVENC:
+		return Args{"-preset", "p4", "-rc", "vbr", "-cq", "25"}
+	case HWAccelQSV:
+		return Args{"-preset", "veryfast", "-global_quality", "25"}
+	case HWAccelVAAPI:
+		return Args{"-qp", "25"}
+	case HWAccelVideoToolbox:
+		return Args{"-q:v", "60"}
+	}
+	return nil
+}
+
+// FilterArgs returns the -vf filter chain needed to scale and upload frames
+// on the appropriate hardware surface for this backend.
+func (c *HWAccelCodec) FilterArgs(videoFilter VideoFilter) Args {
+	scale := videoFilter.String()
+
+	switch c.Preference {
+	case HWAccelNVENC:
+		return Args{"-vf", "scale_npp=" + scale}
+	case HWAccelQSV:
+		return Args{"-vf", "scale_qsv=" + scale}
+	case HWAccelVAAPI:
+		return Args{"-vf", "scale_vaapi=" + scale + ",format=nv12|vaapi,hwupload"}
+	case HWAccelVideoToolbox:
+		return Args{"-vf", scale}
+	}
+	return Args{"-vf", scale}
+}
+
+// hwAccelCandidates lists every hardware codec this package knows how to
+// drive, in the order they should be tried under HWAccelAuto. The H.264
+// variants are listed first since they're what every existing StreamFormat's
+// HWArgs currently targets; the hevc_* variants let DetectHWAccel report
+// hardware encoding as available on hosts whose GPU only exposes HEVC
+// encoding, even before a stream format asks for one via SelectKind.
+func hwAccelCandidates() []HWAccelCodec {
+	return []HWAccelCodec{
+		{Name: "h264_nvenc", Preference: HWAccelNVENC, Kind: HWAccelCodecKindH264, VideoCodec: VideoCodec("h264_nvenc")},
+		{Name: "h264_qsv", Preference: HWAccelQSV, Kind: HWAccelCodecKindH264, VideoCodec: VideoCodec("h264_qsv")},
+		{Name: "h264_vaapi", Preference: HWAccelVAAPI, Kind: HWAccelCodecKindH264, VideoCodec: VideoCodec("h264_vaapi")},
+		{Name: "h264_videotoolbox", Preference: HWAccelVideoToolbox, Kind: HWAccelCodecKindH264, VideoCodec: VideoCodec("h264_videotoolbox")},
+		{Name: "hevc_nvenc", Preference: HWAccelNVENC, Kind: HWAccelCodecKindHEVC, VideoCodec: VideoCodec("hevc_nvenc")},
+		{Name: "hevc_qsv", Preference: HWAccelQSV, Kind: HWAccelCodecKindHEVC, VideoCodec: VideoCodec("hevc_qsv")},
+		{Name: "hevc_vaapi", Preference: HWAccelVAAPI, Kind: HWAccelCodecKindHEVC, VideoCodec: VideoCodec("hevc_vaapi")},
+		{Name: "hevc_videotoolbox", Preference: HWAccelVideoToolbox, Kind: HWAccelCodecKindHEVC, VideoCodec: VideoCodec("hevc_videotoolbox")},
+	}
+}
+
+// HWAccelCapabilities records which hardware encoders were found to be
+// usable on this host.
+type HWAccelCapabilities struct {
+	Available []HWAccelCodec
+}
+
+// Select returns the best H.264 candidate for the given preference, or nil
+// if none of the detected encoders satisfy it. It's a thin wrapper around
+// SelectKind for the existing StreamFormats, which all target H.264 output.
+func (c HWAccelCapabilities) Select(pref HWAccelPreference) *HWAccelCodec {
+	return c.SelectKind(pref, HWAccelCodecKindH264)
+}
+
+// SelectKind returns the best candidate of the given codec kind (H.264 or
+// HEVC) for the given preference, or nil if none of the detected encoders
+// satisfy it.
+func (c HWAccelCapabilities) SelectKind(pref HWAccelPreference, kind HWAccelCodecKind) *HWAccelCodec {
+	for i, codec := range c.Available {
+		if codec.Kind != kind {
+			continue
+		}
+		if pref == HWAccelAuto || codec.Preference == pref {
+			return &c.Available[i]
+		}
+	}
+	return nil
+}
+
+// Preferences returns the HWAccelPreference of every usable encoder found
+// on this host, suitable for exposing on a system-status/capabilities API so
+// a client can show which "auto" backends are actually available, rather
+// than blindly offering every HWAccelPreference constant.
+func (c HWAccelCapabilities) Preferences() []HWAccelPreference {
+	prefs := make([]HWAccelPreference, len(c.Available))
+	for i, codec := range c.Available {
+		prefs[i] = codec.Preference
+	}
+	return prefs
+}
+
+// HWAccelDetector probes ffmpeg for usable hardware encoders once and caches
+// the result, since detection involves spawning ffmpeg several times.
+// Construct one directly (rather than using the package-level
+// DetectHWAccel) to stub probing in tests.
+type HWAccelDetector struct {
+	probe func(ffmpegPath string) HWAccelCapabilities
+
+	once sync.Once
+	caps HWAccelCapabilities
+}
+
+// NewHWAccelDetector returns a detector that probes ffmpeg for real.
+func NewHWAccelDetector() *HWAccelDetector {
+	return &HWAccelDetector{probe: probeHWAccel}
+}
+
+// Detect returns the cached capabilities, probing ffmpegPath the first time
+// it's called.
+func (d *HWAccelDetector) Detect(ffmpegPath string) HWAccelCapabilities {
+	d.once.Do(func() {
+		d.caps = d.probe(ffmpegPath)
+	})
+	return d.caps
+}
+
+var defaultHWAccelDetector = NewHWAccelDetector()
+
+// DetectHWAccel probes ffmpeg for usable hardware encoders and caches the
+// result for the lifetime of the process, using a package-wide detector.
+// Callers that need to stub detection (eg tests) should construct their own
+// HWAccelDetector instead.
+func DetectHWAccel(ffmpegPath string) HWAccelCapabilities {
+	return defaultHWAccelDetector.Detect(ffmpegPath)
+}
+
+func probeHWAccel(ffmpegPath string) HWAccelCapabilities {
+	out, err := exec.Command(ffmpegPath, "-hide_banner", "-encoders").Output()
+	if err != nil {
+		logger.Warnf("[hwaccel] unable to list ffmpeg encoders, disabling hardware transcoding: %v", err)
+		return HWAccelCapabilities{}
+	}
+	encoders := string(out)
+
+	var caps HWAccelCapabilities
+	for _, candidate := range hwAccelCandidates() {
+		if !strings.Contains(encoders, candidate.Name) {
+			continue
+		}
+		if testEncode(ffmpegPath, candidate) {
+			caps.Available = append(caps.Available, candidate)
+		}
+	}
+	return caps
+}
+
+// testEncode attempts a short encode of a synthetic test source using the
+// candidate encoder, to catch encoders that are compiled in but not
+// actually usable on this host (eg no compatible GPU present).
+func testEncode(ffmpegPath string, candidate HWAccelCodec) bool {
+	args := Args{"-hide_banner", "-loglevel", "error"}
+	args = append(args, candidate.DeviceArgs()...)
+	args = append(args,
+		"-f", "lavfi", "-i", "color=c=black:s=64x64:d=0.1",
+		"-frames:v", "1",
+		"-c:v", candidate.Name,
+		"-f", "null", "-",
+	)
+
+	cmd := exec.Command(ffmpegPath, args...)
+	if err := cmd.Run(); err != nil {
+		logger.Debugf("[hwaccel] %s unavailable: %v", candidate.Name, err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,141 @@
+package ffmpeg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHWAccelCodecArgs(t *testing.T) {
+	var filter VideoFilter
+	filter = filter.ScaleMax(1920, 1080, 720)
+
+	tests := []struct {
+		name       string
+		codec      HWAccelCodec
+		wantDevice Args
+		wantEncode Args
+		wantFilter Args
+	}{
+		{
+			name:       "nvenc",
+			codec:      HWAccelCodec{Name: "h264_nvenc", Preference: HWAccelNVENC, VideoCodec: VideoCodec("h264_nvenc")},
+			wantDevice: Args{"-hwaccel", "cuda", "-hwaccel_output_format", "cuda"},
+			wantEncode: Args{"-preset", "p4", "-rc", "vbr", "-cq", "25"},
+			wantFilter: Args{"-vf", "scale_npp=" + filter.String()},
+		},
+		{
+			name:       "qsv",
+			codec:      HWAccelCodec{Name: "h264_qsv", Preference: HWAccelQSV, VideoCodec: VideoCodec("h264_qsv")},
+			wantDevice: Args{"-hwaccel", "qsv", "-hwaccel_output_format", "qsv"},
+			wantEncode: Args{"-preset", "veryfast", "-global_quality", "25"},
+			wantFilter: Args{"-vf", "scale_qsv=" + filter.String()},
+		},
+		{
+			name:       "vaapi",
+			codec:      HWAccelCodec{Name: "h264_vaapi", Preference: HWAccelVAAPI, VideoCodec: VideoCodec("h264_vaapi")},
+			wantDevice: Args{"-init_hw_device", "vaapi=va:/dev/dri/renderD128", "-hwaccel", "vaapi", "-hwaccel_output_format", "vaapi"},
+			wantEncode: Args{"-qp", "25"},
+			wantFilter: Args{"-vf", "scale_vaapi=" + filter.String() + ",format=nv12|vaapi,hwupload"},
+		},
+		{
+			name:       "videotoolbox",
+			codec:      HWAccelCodec{Name: "h264_videotoolbox", Preference: HWAccelVideoToolbox, VideoCodec: VideoCodec("h264_videotoolbox")},
+			wantDevice: Args{"-hwaccel", "videotoolbox"},
+			wantEncode: Args{"-q:v", "60"},
+			wantFilter: Args{"-vf", filter.String()},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.codec.DeviceArgs(); !reflect.DeepEqual(got, tt.wantDevice) {
+				t.Errorf("DeviceArgs() = %v, want %v", got, tt.wantDevice)
+			}
+			if got := tt.codec.EncodeArgs(); !reflect.DeepEqual(got, tt.wantEncode) {
+				t.Errorf("EncodeArgs() = %v, want %v", got, tt.wantEncode)
+			}
+			if got := tt.codec.FilterArgs(filter); !reflect.DeepEqual(got, tt.wantFilter) {
+				t.Errorf("FilterArgs() = %v, want %v", got, tt.wantFilter)
+			}
+		})
+	}
+}
+
+func TestHWAccelCapabilitiesSelect(t *testing.T) {
+	nvenc := HWAccelCodec{Name: "h264_nvenc", Preference: HWAccelNVENC, Kind: HWAccelCodecKindH264}
+	vaapi := HWAccelCodec{Name: "h264_vaapi", Preference: HWAccelVAAPI, Kind: HWAccelCodecKindH264}
+	caps := HWAccelCapabilities{Available: []HWAccelCodec{nvenc, vaapi}}
+
+	if got := caps.Select(HWAccelNVENC); got == nil || got.Name != "h264_nvenc" {
+		t.Errorf("Select(HWAccelNVENC) = %v, want h264_nvenc", got)
+	}
+	if got := caps.Select(HWAccelQSV); got != nil {
+		t.Errorf("Select(HWAccelQSV) = %v, want nil", got)
+	}
+	if got := caps.Select(HWAccelAuto); got == nil || got.Name != "h264_nvenc" {
+		t.Errorf("Select(HWAccelAuto) = %v, want first available (h264_nvenc)", got)
+	}
+	if got := (HWAccelCapabilities{}).Select(HWAccelAuto); got != nil {
+		t.Errorf("Select on empty capabilities = %v, want nil", got)
+	}
+}
+
+// TestHWAccelCapabilitiesSelectKind verifies SelectKind picks the encoder
+// matching both preference and codec kind, so a host with both an H.264 and
+// an HEVC encoder on the same backend doesn't get the wrong one.
+func TestHWAccelCapabilitiesSelectKind(t *testing.T) {
+	h264NVENC := HWAccelCodec{Name: "h264_nvenc", Preference: HWAccelNVENC, Kind: HWAccelCodecKindH264}
+	hevcNVENC := HWAccelCodec{Name: "hevc_nvenc", Preference: HWAccelNVENC, Kind: HWAccelCodecKindHEVC}
+	hevcVAAPI := HWAccelCodec{Name: "hevc_vaapi", Preference: HWAccelVAAPI, Kind: HWAccelCodecKindHEVC}
+	caps := HWAccelCapabilities{Available: []HWAccelCodec{h264NVENC, hevcNVENC, hevcVAAPI}}
+
+	if got := caps.SelectKind(HWAccelNVENC, HWAccelCodecKindHEVC); got == nil || got.Name != "hevc_nvenc" {
+		t.Errorf("SelectKind(HWAccelNVENC, HEVC) = %v, want hevc_nvenc", got)
+	}
+	if got := caps.SelectKind(HWAccelNVENC, HWAccelCodecKindH264); got == nil || got.Name != "h264_nvenc" {
+		t.Errorf("SelectKind(HWAccelNVENC, H264) = %v, want h264_nvenc", got)
+	}
+	if got := caps.SelectKind(HWAccelQSV, HWAccelCodecKindHEVC); got != nil {
+		t.Errorf("SelectKind(HWAccelQSV, HEVC) = %v, want nil", got)
+	}
+	if got := caps.SelectKind(HWAccelAuto, HWAccelCodecKindHEVC); got == nil || got.Name != "hevc_nvenc" {
+		t.Errorf("SelectKind(HWAccelAuto, HEVC) = %v, want first available HEVC (hevc_nvenc)", got)
+	}
+}
+
+func TestHWAccelCapabilitiesPreferences(t *testing.T) {
+	caps := HWAccelCapabilities{Available: []HWAccelCodec{
+		{Name: "h264_nvenc", Preference: HWAccelNVENC},
+		{Name: "h264_vaapi", Preference: HWAccelVAAPI},
+	}}
+
+	want := []HWAccelPreference{HWAccelNVENC, HWAccelVAAPI}
+	if got := caps.Preferences(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Preferences() = %v, want %v", got, want)
+	}
+}
+
+// TestHWAccelDetectorCachesStubProbe verifies HWAccelDetector only invokes
+// its probe func once, and that the result is reusable across calls without
+// needing the package-level DetectHWAccel singleton (and a real ffmpeg
+// binary) in the test.
+func TestHWAccelDetectorCachesStubProbe(t *testing.T) {
+	calls := 0
+	want := HWAccelCapabilities{Available: []HWAccelCodec{{Name: "h264_vaapi", Preference: HWAccelVAAPI}}}
+
+	d := &HWAccelDetector{probe: func(ffmpegPath string) HWAccelCapabilities {
+		calls++
+		return want
+	}}
+
+	for i := 0; i < 3; i++ {
+		got := d.Detect("/usr/bin/ffmpeg")
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("Detect() = %v, want %v", got, want)
+		}
+	}
+
+	if calls != 1 {
+		t.Errorf("probe called %d times, want 1", calls)
+	}
+}
@@ -0,0 +1,204 @@
+package ffmpeg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stashapp/stash/pkg/file"
+	"github.com/stashapp/stash/pkg/logger"
+)
+
+const (
+	spriteColumns    = 10
+	spriteRows       = 10
+	spriteTileWidth  = 160
+	spriteTileHeight = 90
+)
+
+// SpriteGenerator produces a mosaic sprite image plus a WebVTT file mapping
+// timestamps to regions of that mosaic, for hover-scrub previews in
+// video.js/hls.js. It replaces a single-image-per-scene thumbnail for
+// scrubbing purposes.
+type SpriteGenerator struct {
+	sm       *StreamManager
+	cacheDir string
+
+	mu    sync.Mutex
+	calls map[int]*spriteCall // keyed by scene ID, coalesces concurrent generation
+}
+
+type spriteCall struct {
+	wg  sync.WaitGroup
+	err error
+}
+
+// NewSpriteGenerator creates a SpriteGenerator rooted at cacheDir, which is
+// created if it does not already exist.
+func NewSpriteGenerator(sm *StreamManager, cacheDir string) (*SpriteGenerator, error) {
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return nil, fmt.Errorf("creating sprite cache dir: %w", err)
+	}
+
+	return &SpriteGenerator{
+		sm:       sm,
+		cacheDir: cacheDir,
+		calls:    make(map[int]*spriteCall),
+	}, nil
+}
+
+func (g *SpriteGenerator) paths(sceneID int) (imagePath, vttPath string) {
+	return filepath.Join(g.cacheDir, fmt.Sprintf("%d_sprite.jpg", sceneID)),
+		filepath.Join(g.cacheDir, fmt.Sprintf("%d_sprite.vtt", sceneID))
+}
+
+// ensure returns the sprite image and VTT paths for sceneID, generating or
+// regenerating them if they are missing or older than the source file.
+func (g *SpriteGenerator) ensure(sceneID int, videoFile *file.VideoFile) (string, string, error) {
+	imagePath, vttPath := g.paths(sceneID)
+
+	if g.isFresh(videoFile, imagePath, vttPath) {
+		return imagePath, vttPath, nil
+	}
+
+	g.mu.Lock()
+	call, loaded := g.calls[sceneID]
+	if !loaded {
+		call = &spriteCall{}
+		g.calls[sceneID] = call
+		call.wg.Add(1)
+		go func() {
+			defer func() {
+				g.mu.Lock()
+				delete(g.calls, sceneID)
+				g.mu.Unlock()
+				call.wg.Done()
+			}()
+			call.err = g.generate(videoFile, imagePath, vttPath)
+		}()
+	}
+	g.mu.Unlock()
+
+	call.wg.Wait()
+	if call.err != nil {
+		return "", "", call.err
+	}
+	return imagePath, vttPath, nil
+}
+
+// isFresh reports whether both the sprite and its VTT already exist and
+// were generated at or after the source file's current mtime.
+func (g *SpriteGenerator) isFresh(videoFile *file.VideoFile, imagePath, vttPath string) bool {
+	srcInfo, err := os.Stat(videoFile.Path)
+	if err != nil {
+		return false
+	}
+
+	imgInfo, err := os.Stat(imagePath)
+	if err != nil || imgInfo.ModTime().Before(srcInfo.ModTime()) {
+		return false
+	}
+
+	vttInfo, err := os.Stat(vttPath)
+	return err == nil && !vttInfo.ModTime().Before(srcInfo.ModTime())
+}
+
+// generate samples spriteColumns*spriteRows frames evenly across the
+// file's duration with a single ffmpeg invocation, tiling them into one
+// mosaic image, then writes the accompanying WebVTT.
+func (g *SpriteGenerator) generate(videoFile *file.VideoFile, imagePath, vttPath string) error {
+	count := spriteColumns * spriteRows
+	interval := videoFile.Duration / float64(count)
+	if interval <= 0 {
+		interval = 1
+	}
+
+	args := Args{"-hide_banner"}
+	args = args.LogLevel(LogLevelError)
+	args = args.Input(videoFile.Path)
+	args = append(args,
+		"-frames:v", "1",
+		"-vf", fmt.Sprintf("fps=1/%f,scale=%d:%d,tile=%dx%d", interval, spriteTileWidth, spriteTileHeight, spriteColumns, spriteRows),
+	)
+	args = args.Output(imagePath)
+
+	// Hold a read lock on the source file for the lifetime of the encode, the
+	// same as any other transcode path in this package, so a concurrent
+	// library rescan can't move or delete it out from under ffmpeg.
+	lockCtx := g.sm.lockManager.ReadLock(context.Background(), videoFile.Path)
+	cmd := g.sm.encoder.Command(lockCtx, args)
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("generating sprite for %s: %w", videoFile.Path, err)
+	}
+	lockCtx.AttachCommand(cmd)
+
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("generating sprite for %s: %w", videoFile.Path, err)
+	}
+
+	return writeSpriteVTT(vttPath, filepath.Base(imagePath), count, interval)
+}
+
+func writeSpriteVTT(vttPath, imageName string, count int, interval float64) error {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n\n")
+
+	for i := 0; i < count; i++ {
+		start := time.Duration(float64(i) * interval * float64(time.Second))
+		end := time.Duration(float64(i+1) * interval * float64(time.Second))
+
+		col := i % spriteColumns
+		row := i / spriteColumns
+		x := col * spriteTileWidth
+		y := row * spriteTileHeight
+
+		fmt.Fprintf(&b, "%s --> %s\n%s#xywh=%d,%d,%d,%d\n\n",
+			formatVTTTimestamp(start), formatVTTTimestamp(end),
+			imageName, x, y, spriteTileWidth, spriteTileHeight,
+		)
+	}
+
+	return os.WriteFile(vttPath, []byte(b.String()), 0644)
+}
+
+func formatVTTTimestamp(d time.Duration) string {
+	h := int(d.Hours())
+	m := int(d.Minutes()) % 60
+	s := int(d.Seconds()) % 60
+	ms := int(d.Milliseconds()) % 1000
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", h, m, s, ms)
+}
+
+// ServeSprite serves (generating if necessary) the mosaic sprite image for
+// a scene.
+func (g *SpriteGenerator) ServeSprite(w http.ResponseWriter, r *http.Request, sceneID int, videoFile *file.VideoFile) {
+	imagePath, _, err := g.ensure(sceneID, videoFile)
+	if err != nil {
+		logger.Errorf("[sprite] error generating sprite for scene %d: %v", sceneID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeFile(w, r, imagePath)
+}
+
+// ServeSpriteVTT serves (generating if necessary) the WebVTT scrubbing
+// track for a scene.
+func (g *SpriteGenerator) ServeSpriteVTT(w http.ResponseWriter, r *http.Request, sceneID int, videoFile *file.VideoFile) {
+	_, vttPath, err := g.ensure(sceneID, videoFile)
+	if err != nil {
+		logger.Errorf("[sprite] error generating sprite vtt for scene %d: %v", sceneID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/vtt")
+	http.ServeFile(w, r, vttPath)
+}
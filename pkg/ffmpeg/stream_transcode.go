@@ -17,6 +17,14 @@ import (
 type StreamFormat struct {
 	MimeType string
 	Args     func(videoFilter VideoFilter, videoOnly bool) Args
+	// HWArgs builds the same pipeline using a hardware encoder. It is nil for
+	// formats that have no hardware equivalent (eg MKV passthrough).
+	HWArgs func(hw *HWAccelCodec, videoFilter VideoFilter, videoOnly bool) Args
+	// CopyArgs builds the pipeline when ShouldCopy has determined that the
+	// video and/or audio streams can be muxed through unchanged. videoFilter
+	// is only applied when copyVideo is false, since a stream copy can't be
+	// scaled.
+	CopyArgs func(videoFilter VideoFilter, copyVideo, copyAudio, videoOnly bool) Args
 }
 
 var (
@@ -39,6 +47,44 @@ var (
 			args = args.Format(FormatMP4)
 			return
 		},
+		HWArgs: func(hw *HWAccelCodec, videoFilter VideoFilter, videoOnly bool) (args Args) {
+			args = args.VideoCodec(hw.VideoCodec)
+			args = append(args, hw.EncodeArgs()...)
+			args = append(args,
+				"-movflags", "frag_keyframe+empty_moov",
+			)
+			args = append(args, hw.FilterArgs(videoFilter)...)
+			if videoOnly {
+				args = args.SkipAudio()
+			} else {
+				args = append(args, "-ac", "2")
+			}
+			args = args.Format(FormatMP4)
+			return
+		},
+		CopyArgs: func(videoFilter VideoFilter, copyVideo, copyAudio, videoOnly bool) (args Args) {
+			if copyVideo {
+				args = args.VideoCodec(VideoCodecCopy)
+			} else {
+				args = args.VideoCodec(VideoCodecLibX264)
+				args = append(args,
+					"-pix_fmt", "yuv420p",
+					"-preset", "veryfast",
+					"-crf", "25",
+				)
+				args = args.VideoFilter(videoFilter)
+			}
+			args = append(args, "-movflags", "frag_keyframe+empty_moov")
+			if videoOnly {
+				args = args.SkipAudio()
+			} else if copyAudio {
+				args = args.AudioCodec(AudioCodecCopy)
+			} else {
+				args = append(args, "-ac", "2")
+			}
+			args = args.Format(FormatMP4)
+			return
+		},
 	}
 	StreamTypeWEBM = StreamFormat{
 		MimeType: MimeWebmVideo,
@@ -61,6 +107,31 @@ var (
 			args = args.Format(FormatWebm)
 			return
 		},
+		CopyArgs: func(videoFilter VideoFilter, copyVideo, copyAudio, videoOnly bool) (args Args) {
+			if copyVideo {
+				args = args.VideoCodec(VideoCodecCopy)
+			} else {
+				args = args.VideoCodec(VideoCodecVP9)
+				args = append(args,
+					"-pix_fmt", "yuv420p",
+					"-deadline", "realtime",
+					"-cpu-used", "5",
+					"-row-mt", "1",
+					"-crf", "30",
+					"-b:v", "0",
+				)
+				args = args.VideoFilter(videoFilter)
+			}
+			if videoOnly {
+				args = args.SkipAudio()
+			} else if copyAudio {
+				args = args.AudioCodec(AudioCodecCopy)
+			} else {
+				args = append(args, "-ac", "2")
+			}
+			args = args.Format(FormatWebm)
+			return
+		},
 	}
 	StreamTypeMKV = StreamFormat{
 		MimeType: MimeMkvVideo,
@@ -79,27 +150,64 @@ var (
 			args = args.Format(FormatMatroska)
 			return
 		},
+		// MKV already copies video unconditionally; the only thing worth
+		// skipping here is the audio transcode when the source audio is
+		// already something browsers can decode out of an MKV container.
+		CopyArgs: func(videoFilter VideoFilter, copyVideo, copyAudio, videoOnly bool) (args Args) {
+			args = args.VideoCodec(VideoCodecCopy)
+			if videoOnly {
+				args = args.SkipAudio()
+			} else if copyAudio {
+				args = args.AudioCodec(AudioCodecCopy)
+			} else {
+				args = args.AudioCodec(AudioCodecLibOpus)
+				args = append(args,
+					"-b:a", "96k",
+					"-vbr", "on",
+					"-ac", "2",
+				)
+			}
+			args = args.Format(FormatMatroska)
+			return
+		},
 	}
 )
 
 type TranscodeOptions struct {
 	StreamType StreamFormat
 	VideoFile  *file.VideoFile
-	Resolution string
-	StartTime  float64
+	// Resolution is a models.StreamingResolutionEnum value, or "auto" to
+	// pick the bitrate ladder rung nearest ViewportHeight.
+	Resolution     string
+	StartTime      float64
+	ViewportHeight int
 }
 
 func (o TranscodeOptions) makeStreamArgs(sm *StreamManager) Args {
 	maxTranscodeSize := sm.config.GetMaxStreamingTranscodeSize().GetMaxResolution()
-	if o.Resolution != "" {
+
+	var rung *BitrateLadderRung
+	switch {
+	case o.Resolution == "auto":
+		r := NearestRung(o.VideoFile, o.ViewportHeight)
+		rung = &r
+		maxTranscodeSize = r.Height
+	case o.Resolution != "":
 		maxTranscodeSize = models.StreamingResolutionEnum(o.Resolution).GetMaxResolution()
 	}
+
 	extraInputArgs := sm.config.GetLiveTranscodeInputArgs()
 	extraOutputArgs := sm.config.GetLiveTranscodeOutputArgs()
 
+	hw := resolveHWAccel(sm, o.StreamType)
+
 	args := Args{"-hide_banner"}
 	args = args.LogLevel(LogLevelError)
 
+	if hw != nil {
+		args = append(args, hw.DeviceArgs()...)
+	}
+
 	args = append(args, extraInputArgs...)
 
 	if o.StartTime != 0 {
@@ -113,7 +221,23 @@ func (o TranscodeOptions) makeStreamArgs(sm *StreamManager) Args {
 	var videoFilter VideoFilter
 	videoFilter = videoFilter.ScaleMax(o.VideoFile.Width, o.VideoFile.Height, maxTranscodeSize)
 
-	args = append(args, o.StreamType.Args(videoFilter, videoOnly)...)
+	copyVideo, copyAudio := ShouldCopy(o.VideoFile, o.StreamType, maxTranscodeSize)
+
+	switch {
+	case o.StreamType.CopyArgs != nil && (copyVideo || copyAudio):
+		// Passthrough takes priority over hardware encoding. When only the
+		// audio can be copied, CopyArgs re-encodes the video in software, so
+		// the hardware encoder is not used in that case.
+		args = append(args, o.StreamType.CopyArgs(videoFilter, copyVideo, copyAudio, videoOnly)...)
+	case hw != nil:
+		args = append(args, o.StreamType.HWArgs(hw, videoFilter, videoOnly)...)
+	default:
+		args = append(args, o.StreamType.Args(videoFilter, videoOnly)...)
+	}
+
+	if rung != nil && !copyVideo {
+		args = append(args, rung.RateControlArgs()...)
+	}
 
 	args = append(args, extraOutputArgs...)
 
@@ -122,7 +246,28 @@ func (o TranscodeOptions) makeStreamArgs(sm *StreamManager) Args {
 	return args
 }
 
+// resolveHWAccel returns the hardware encoder to use for streamType, or nil
+// if hardware transcoding is disabled, unavailable, or unsupported for this
+// format.
+func resolveHWAccel(sm *StreamManager, streamType StreamFormat) *HWAccelCodec {
+	if streamType.HWArgs == nil {
+		return nil
+	}
+
+	pref := sm.config.GetTranscodeHWAccel()
+	if pref == HWAccelDisabled {
+		return nil
+	}
+
+	caps := DetectHWAccel(sm.encoder.Path())
+	return caps.Select(pref)
+}
+
 func (sm *StreamManager) ServeTranscode(w http.ResponseWriter, r *http.Request, options TranscodeOptions) {
+	if options.Resolution == "auto" {
+		options.ViewportHeight = viewportHeightHint(r)
+	}
+
 	streamRequestCtx := NewStreamRequestContext(w, r)
 	lockCtx := sm.lockManager.ReadLock(streamRequestCtx, options.VideoFile.Path)
 
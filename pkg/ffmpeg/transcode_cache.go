@@ -0,0 +1,232 @@
+package ffmpeg
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/stashapp/stash/pkg/file"
+)
+
+// TranscodeCacheKey identifies a single cached, already-transcoded segment.
+type TranscodeCacheKey struct {
+	FileHash   string
+	StreamType string
+	Resolution string
+	ChunkIndex int
+}
+
+func (k TranscodeCacheKey) filename() string {
+	return fmt.Sprintf("%s_%s_%s_%d", k.FileHash, sanitizeForFilename(k.StreamType), sanitizeForFilename(k.Resolution), k.ChunkIndex)
+}
+
+func sanitizeForFilename(s string) string {
+	return strings.NewReplacer("/", "-", " ", "_").Replace(s)
+}
+
+// fileCacheKey returns a stable identifier for videoFile suitable for use
+// as a TranscodeCacheKey.FileHash. It is derived from the indexed path
+// rather than the file's contents, matching how the rest of this package
+// already treats the indexed path as the file's identity.
+func fileCacheKey(videoFile *file.VideoFile) string {
+	sum := sha256.Sum256([]byte(videoFile.Path))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+type transcodeCacheEntry struct {
+	key  TranscodeCacheKey
+	size int64
+}
+
+// TranscodeCacheStats is a snapshot of TranscodeCache's hit/miss/eviction
+// counters, suitable for exposing on a stats endpoint.
+type TranscodeCacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	BytesUsed int64
+}
+
+// HitRatio returns Hits / (Hits + Misses), or 0 if there have been no
+// lookups yet.
+func (s TranscodeCacheStats) HitRatio() float64 {
+	total := s.Hits + s.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(total)
+}
+
+// TranscodeCache persists finished transcode segments to disk, keyed by
+// (file, stream type, resolution, chunk index), and evicts the
+// least-recently-used entries once the cache exceeds maxBytes. It also
+// coalesces concurrent requests for the same missing entry onto a single
+// generator call, the same way sm.lockManager coalesces concurrent readers
+// of a file.
+type TranscodeCache struct {
+	baseDir  string
+	maxBytes int64
+
+	mu       sync.Mutex
+	lru      *list.List
+	items    map[TranscodeCacheKey]*list.Element
+	curBytes int64
+	stats    TranscodeCacheStats
+
+	inflightMu sync.Mutex
+	inflight   map[TranscodeCacheKey]*transcodeCacheCall
+}
+
+type transcodeCacheCall struct {
+	wg   sync.WaitGroup
+	data []byte
+	err  error
+}
+
+// NewTranscodeCache creates a TranscodeCache rooted at baseDir, which is
+// created if it does not already exist.
+func NewTranscodeCache(baseDir string, maxBytes int64) (*TranscodeCache, error) {
+	if err := os.MkdirAll(baseDir, 0755); err != nil {
+		return nil, fmt.Errorf("creating transcode cache dir: %w", err)
+	}
+
+	return &TranscodeCache{
+		baseDir:  baseDir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		items:    make(map[TranscodeCacheKey]*list.Element),
+		inflight: make(map[TranscodeCacheKey]*transcodeCacheCall),
+	}, nil
+}
+
+func (c *TranscodeCache) path(key TranscodeCacheKey) string {
+	return filepath.Join(c.baseDir, key.filename())
+}
+
+// Get returns the cached bytes for key, if present.
+func (c *TranscodeCache) Get(key TranscodeCacheKey) ([]byte, bool) {
+	c.mu.Lock()
+	el, ok := c.items[key]
+	if !ok {
+		c.stats.Misses++
+		c.mu.Unlock()
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	c.stats.Hits++
+	c.mu.Unlock()
+
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		// the file vanished from under us (eg manual cleanup); drop the
+		// now-stale index entry so future lookups miss cleanly.
+		c.mu.Lock()
+		if el, ok := c.items[key]; ok {
+			c.removeElementLocked(el)
+		}
+		c.mu.Unlock()
+		return nil, false
+	}
+	return data, true
+}
+
+// Put stores data under key, persisting it to disk and evicting older
+// entries if this push takes the cache over its size cap.
+func (c *TranscodeCache) Put(key TranscodeCacheKey, data []byte) error {
+	if err := os.WriteFile(c.path(key), data, 0644); err != nil {
+		return fmt.Errorf("writing transcode cache entry: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		// the file on disk has just been overwritten with data, so only the
+		// stale index entry is dropped here, not the file itself.
+		c.lru.Remove(el)
+		delete(c.items, key)
+		c.curBytes -= el.Value.(*transcodeCacheEntry).size
+	}
+
+	el := c.lru.PushFront(&transcodeCacheEntry{key: key, size: int64(len(data))})
+	c.items[key] = el
+	c.curBytes += int64(len(data))
+
+	c.evictLocked()
+	c.stats.BytesUsed = c.curBytes
+
+	return nil
+}
+
+// evictLocked removes least-recently-used entries until the cache is back
+// under its size cap. Callers must hold c.mu.
+func (c *TranscodeCache) evictLocked() {
+	for c.curBytes > c.maxBytes && c.lru.Len() > 0 {
+		back := c.lru.Back()
+		c.removeElementLocked(back)
+		c.stats.Evictions++
+	}
+}
+
+// removeElementLocked drops el from the index and deletes its backing
+// file. Callers must hold c.mu.
+func (c *TranscodeCache) removeElementLocked(el *list.Element) {
+	entry := el.Value.(*transcodeCacheEntry)
+	c.lru.Remove(el)
+	delete(c.items, entry.key)
+	c.curBytes -= entry.size
+	_ = os.Remove(c.path(entry.key))
+}
+
+// GetOrGenerate returns the cached bytes for key, calling generate to
+// produce and cache them if they are missing. Concurrent calls for the
+// same key coalesce onto a single generate call, the same way sprite.go's
+// ensure() coalesces concurrent sprite generation: the check, the call's
+// creation and its wg.Add(1) all happen while holding inflightMu, so a
+// second caller can never observe a call whose WaitGroup hasn't been
+// incremented yet.
+func (c *TranscodeCache) GetOrGenerate(key TranscodeCacheKey, generate func() ([]byte, error)) ([]byte, error) {
+	if data, ok := c.Get(key); ok {
+		return data, nil
+	}
+
+	c.inflightMu.Lock()
+	call, loaded := c.inflight[key]
+	if !loaded {
+		call = &transcodeCacheCall{}
+		call.wg.Add(1)
+		c.inflight[key] = call
+	}
+	c.inflightMu.Unlock()
+
+	if !loaded {
+		go func() {
+			defer func() {
+				c.inflightMu.Lock()
+				delete(c.inflight, key)
+				c.inflightMu.Unlock()
+			}()
+			defer call.wg.Done()
+
+			call.data, call.err = generate()
+			if call.err == nil {
+				call.err = c.Put(key, call.data)
+			}
+		}()
+	}
+
+	call.wg.Wait()
+	return call.data, call.err
+}
+
+// Stats returns a snapshot of the cache's hit/miss/eviction counters.
+func (c *TranscodeCache) Stats() TranscodeCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}